@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Command snapshots is a small operator CLI for answering "what snapshots does this node hold and which
+// are hottest?" directly off disk, without going through the /snapshots admin HTTP endpoint.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "list":
+		runList(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: snapshots list -base-folder <dir> [-image <substr>] [-state <states>] [-min-age <duration>] [-sort-by <created|last-used|size|image>] [-json]")
+}
+
+// runList implements the "list" subcommand: load the snapshot inventory from baseFolder and print it,
+// filtered and sorted the same way ListSnapshots does for the HTTP endpoint.
+func runList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	baseFolder := fs.String("base-folder", "", "snapshot manager base folder to inspect (required)")
+	image := fs.String("image", "", "keep only snapshots whose image contains this substring")
+	state := fs.String("state", "", "comma-separated states to keep (creating,active,idle)")
+	minAge := fs.Duration("min-age", 0, "keep only snapshots created at least this long ago")
+	sortBy := fs.String("sort-by", "created", "sort order: created, last-used, size or image")
+	asJSON := fs.Bool("json", false, "print the raw SnapshotInfo list as JSON instead of a table")
+	_ = fs.Parse(args)
+
+	if *baseFolder == "" {
+		fmt.Fprintln(os.Stderr, "list: -base-folder is required")
+		os.Exit(2)
+	}
+
+	filter := snapshotting.ListFilter{
+		ImageSubstring: *image,
+		MinAge:         *minAge,
+		SortBy:         *sortBy,
+	}
+	if *state != "" {
+		filter.States = strings.Split(*state, ",")
+	}
+
+	// A nil policy disables eviction and WithReadOnly stops Load from pruning manifest-less directories
+	// as orphans, which is what a read-only inspection tool wants: it must not reclaim anything on the
+	// node it's inspecting, including a real snapshot that's simply still mid-creation.
+	mgr := snapshotting.NewSnapshotManager(*baseFolder, nil, snapshotting.WithReadOnly())
+	infos := mgr.ListSnapshots(filter)
+
+	if *asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(infos); err != nil {
+			fmt.Fprintln(os.Stderr, "list:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	printTable(infos)
+}
+
+func printTable(infos []snapshotting.SnapshotInfo) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintln(tw, "ID\tIMAGE\tSTATE\tCREATED\tLAST USED\tSIZE\tDESCRIPTION")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			info.ID, info.Image, info.State,
+			info.CreatedAt.Format(time.RFC3339), info.LastUsedAt.Format(time.RFC3339),
+			info.SizeBytes, info.Description)
+	}
+}
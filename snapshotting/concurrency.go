@@ -0,0 +1,69 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+// ManagerOption configures optional behavior on a SnapshotManager at construction time.
+type ManagerOption func(*SnapshotManager)
+
+// WithCoalesceCreates makes InitSnapshot coalesce concurrent creates for the same image: instead of
+// redundantly cold-booting a new VM per caller, only the first InitSnapshot for an image actually creates
+// a snapshot. Later callers for that image wait for that creation to be committed (or aborted) and then
+// acquire the result themselves through AcquireSnapshot, rather than being handed the first caller's
+// in-progress snapshot directly - a single Snapshot can only ever be driven by one VM at a time.
+func WithCoalesceCreates() ManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.coalesceCreates = true
+	}
+}
+
+// WithReadOnly gives the manager a persister that only inspects baseFolder: Load leaves snapshot
+// directories that have no manifest yet in place instead of pruning them as orphans. Use this for a
+// manager that doesn't own baseFolder - in particular one instantiated by an operator CLI against a
+// directory a live SnapshotManager elsewhere is still writing to, where an in-progress real snapshot
+// can easily have no manifest yet and must not be deleted out from under it. The option changes nothing
+// else: NewSnapshotManager still creates baseFolder if it is missing, and the manager's methods that
+// create, commit or evict snapshots still write to it.
+func WithReadOnly() ManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.persister = NewReadOnlyJSONPersister(mgr.baseFolder)
+	}
+}
+
+// WithBootConfig records the kernel args and firecracker version this node boots its VMs with, so
+// ExportSnapshot can stamp them into the manifests it produces and ImportSnapshot can reject a snapshot
+// that isn't actually bootable here. Leaving either argument empty disables the corresponding check.
+func WithBootConfig(kernelArgs, firecrackerVersion string) ManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.kernelArgs = kernelArgs
+		mgr.firecrackerVersion = firecrackerVersion
+	}
+}
+
+// creationFuture tracks an in-flight InitSnapshot call so later callers for the same image can wait for it
+// to be committed or aborted instead of starting a redundant cold boot. vmID identifies the creator the
+// future was opened for, so CommitSnapshot/AbortSnapshot calls for unrelated vmIDs never resolve it early.
+type creationFuture struct {
+	done chan struct{}
+	vmID string
+	err  error
+}
@@ -0,0 +1,273 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SnapshotPolicy bounds how many idle snapshots a SnapshotManager is allowed to keep on disk. A nil
+// *SnapshotPolicy passed to NewSnapshotManager disables eviction entirely, which is what benchmarks want.
+type SnapshotPolicy struct {
+	// MaxTotalBytes is the maximum number of bytes all idle snapshots together may occupy on disk.
+	// Zero means unbounded.
+	MaxTotalBytes int64
+	// MaxCountPerImage is the maximum number of idle snapshots kept for a single image. Zero means
+	// unbounded.
+	MaxCountPerImage int
+	// MaxIdleAge is the maximum time a snapshot may sit idle before it becomes eligible for eviction.
+	// Zero means unbounded.
+	MaxIdleAge time.Duration
+}
+
+var (
+	snapshotEvictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vhive_snapshot_evictions_total",
+		Help: "Total number of idle snapshots evicted to satisfy the configured snapshot policy.",
+	})
+	snapshotIdleBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vhive_snapshot_idle_bytes",
+		Help: "Current number of bytes occupied on disk by idle snapshots.",
+	})
+)
+
+// evict deletes idle snapshots until mgr.policy is satisfied. It is a no-op if no policy is configured.
+// It is called from CommitSnapshot right after a new snapshot is committed, and periodically from the
+// background eviction goroutine so ageing-out snapshots are reclaimed even without fresh commits.
+func (mgr *SnapshotManager) evict() {
+	if mgr.policy == nil {
+		return
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	for image := range mgr.idleSnapshots {
+		mgr.evictAgedOut(image)
+		mgr.evictOverCount(image)
+	}
+	mgr.evictOverTotalBytes()
+
+	snapshotIdleBytes.Set(float64(mgr.idleBytesLocked()))
+}
+
+// evictAgedOut removes idle snapshots of image that have been idle for longer than mgr.policy.MaxIdleAge.
+// A parent snapshot is kept past its age-out point as long as any of its replicas still exists, idle or
+// active, following the same
+// replicas-before-parent ordering evictOverCount/evictOverTotalBytes use, so a replicated image's parent
+// doesn't vanish out from under replicas that are still usable.
+func (mgr *SnapshotManager) evictAgedOut(image string) {
+	if mgr.policy.MaxIdleAge == 0 {
+		return
+	}
+
+	idles := mgr.idleSnapshots[image]
+	mgr.sortByLastUsed(idles)
+
+	now := time.Now()
+	kept := idles[:0]
+	for _, snap := range idles {
+		id := snap.GetId()
+		agedOut := now.Sub(mgr.lastUsed[id]) > mgr.policy.MaxIdleAge
+		if agedOut && (mgr.isReplicaLocked(id) || !mgr.hasLiveReplicasLocked(id)) {
+			mgr.evictSnapshot(snap)
+			continue
+		}
+		kept = append(kept, snap)
+	}
+	mgr.idleSnapshots[image] = kept
+}
+
+// evictOverCount removes the least-recently-used idle snapshots of image beyond mgr.policy.MaxCountPerImage.
+func (mgr *SnapshotManager) evictOverCount(image string) {
+	if mgr.policy.MaxCountPerImage == 0 {
+		return
+	}
+
+	idles := mgr.idleSnapshots[image]
+	if len(idles) <= mgr.policy.MaxCountPerImage {
+		return
+	}
+
+	mgr.sortByLastUsed(idles)
+	victims := idles[:len(idles)-mgr.policy.MaxCountPerImage]
+	for _, snap := range victims {
+		mgr.evictSnapshot(snap)
+	}
+	mgr.idleSnapshots[image] = idles[len(idles)-mgr.policy.MaxCountPerImage:]
+}
+
+// evictOverTotalBytes removes the globally least-recently-used idle snapshots until the total size of
+// all idle snapshots fits within mgr.policy.MaxTotalBytes.
+func (mgr *SnapshotManager) evictOverTotalBytes() {
+	if mgr.policy.MaxTotalBytes == 0 {
+		return
+	}
+
+	for mgr.idleBytesLocked() > mgr.policy.MaxTotalBytes {
+		image, snap := mgr.oldestIdleLocked()
+		if snap == nil {
+			return
+		}
+		mgr.evictSnapshot(snap)
+		mgr.idleSnapshots[image] = removeSnapshot(mgr.idleSnapshots[image], snap)
+	}
+}
+
+// oldestIdleLocked returns the idle snapshot with the oldest lastUsed stamp across all images. Replicas
+// are always preferred over their parent, and a parent is only returned once none of its replicas exist
+// any more, idle or active.
+func (mgr *SnapshotManager) oldestIdleLocked() (string, *Snapshot) {
+	if image, snap := mgr.oldestMatchingLocked(mgr.isReplicaLocked); snap != nil {
+		return image, snap
+	}
+	return mgr.oldestMatchingLocked(func(id string) bool { return !mgr.hasLiveReplicasLocked(id) })
+}
+
+func (mgr *SnapshotManager) oldestMatchingLocked(keep func(id string) bool) (string, *Snapshot) {
+	var oldestImage string
+	var oldest *Snapshot
+	var oldestTime time.Time
+
+	for image, idles := range mgr.idleSnapshots {
+		for _, snap := range idles {
+			if !keep(snap.GetId()) {
+				continue
+			}
+			t := mgr.lastUsed[snap.GetId()]
+			if oldest == nil || t.Before(oldestTime) {
+				oldest, oldestTime, oldestImage = snap, t, image
+			}
+		}
+	}
+
+	return oldestImage, oldest
+}
+
+// sortByLastUsed orders idles so the front of the slice is the next eviction victim: replicas first (so
+// they are freed before their parent), then oldest-used-first within each group.
+func (mgr *SnapshotManager) sortByLastUsed(idles []*Snapshot) {
+	sort.Slice(idles, func(i, j int) bool {
+		iReplica, jReplica := mgr.isReplicaLocked(idles[i].GetId()), mgr.isReplicaLocked(idles[j].GetId())
+		if iReplica != jReplica {
+			return iReplica
+		}
+		return mgr.lastUsed[idles[i].GetId()].Before(mgr.lastUsed[idles[j].GetId()])
+	})
+}
+
+// isReplicaLocked reports whether id was produced by Replicate rather than InitSnapshot/CommitSnapshot.
+func (mgr *SnapshotManager) isReplicaLocked(id string) bool {
+	_, ok := mgr.parentID[id]
+	return ok
+}
+
+// hasLiveReplicasLocked reports whether any replica of the snapshot identified by id still exists.
+func (mgr *SnapshotManager) hasLiveReplicasLocked(id string) bool {
+	for _, parent := range mgr.parentID {
+		if parent == id {
+			return true
+		}
+	}
+	return false
+}
+
+// evictSnapshot cleans up snap's on-disk state and its bookkeeping. The caller must hold mgr.Mutex and
+// is responsible for removing snap from mgr.idleSnapshots.
+func (mgr *SnapshotManager) evictSnapshot(snap *Snapshot) {
+	if err := snap.Cleanup(); err != nil {
+		log.Warnf("failed to clean up evicted snapshot %s: %s", snap.GetId(), err)
+	}
+	if err := mgr.persister.Invalidate(snap.GetId()); err != nil {
+		log.Warnf("failed to invalidate manifest for evicted snapshot %s: %s", snap.GetId(), err)
+	}
+	delete(mgr.lastUsed, snap.GetId())
+	delete(mgr.createdAt, snap.GetId())
+	delete(mgr.description, snap.GetId())
+	delete(mgr.sizeBytes, snap.GetId())
+	delete(mgr.parentID, snap.GetId())
+	snapshotEvictionsTotal.Inc()
+}
+
+// idleBytesLocked returns the total on-disk size of all idle snapshots, from the sizeBytes cache
+// populated by commitIdle/persister.Load rather than by re-walking disk, since this runs on every commit
+// while mgr.Mutex is held. The caller must hold mgr.Mutex.
+func (mgr *SnapshotManager) idleBytesLocked() int64 {
+	var total int64
+	for _, idles := range mgr.idleSnapshots {
+		for _, snap := range idles {
+			total += mgr.sizeBytes[snap.GetId()]
+		}
+	}
+	return total
+}
+
+// ForgetSnapshot evicts a single idle snapshot of image by id, for manual operator-triggered removal
+// outside of the regular policy sweep.
+func (mgr *SnapshotManager) ForgetSnapshot(image string, id string) error {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	idles := mgr.idleSnapshots[image]
+	for _, snap := range idles {
+		if snap.GetId() != id {
+			continue
+		}
+		mgr.evictSnapshot(snap)
+		mgr.idleSnapshots[image] = removeSnapshot(idles, snap)
+		return nil
+	}
+
+	return errors.Errorf("no idle snapshot %s found for image %s", id, image)
+}
+
+// removeSnapshot returns idles with snap removed, preserving order.
+func removeSnapshot(idles []*Snapshot, snap *Snapshot) []*Snapshot {
+	for i, s := range idles {
+		if s == snap {
+			return append(idles[:i], idles[i+1:]...)
+		}
+	}
+	return idles
+}
+
+// dirSize walks path and sums the size of every regular file under it. Errors walking individual
+// entries are ignored so a half-evicted directory doesn't wedge the policy sweep.
+func dirSize(path string) int64 {
+	var total int64
+	_ = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		total += info.Size()
+		return nil
+	})
+	return total
+}
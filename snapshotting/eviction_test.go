@@ -0,0 +1,144 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEvictOverCountVictimOrdering(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), &SnapshotPolicy{MaxCountPerImage: 2})
+	defer mgr.Close()
+
+	const image = "test-image"
+	for _, id := range []string{"vm-1", "vm-2", "vm-3"} {
+		snap, err := mgr.InitSnapshot(id, image, "")
+		if err != nil {
+			t.Fatalf("InitSnapshot(%s): %s", id, err)
+		}
+		writeDummyFile(t, snap.GetMemFilePath(), 1)
+		writeDummyFile(t, snap.GetSnapFilePath(), 1)
+		if err := mgr.CommitSnapshot(id); err != nil {
+			t.Fatalf("CommitSnapshot(%s): %s", id, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	idles := idleIDs(mgr, image)
+	if len(idles) != 2 {
+		t.Fatalf("expected 2 idle snapshots after evicting over count, got %d: %v", len(idles), idles)
+	}
+	if idles["vm-1"] {
+		t.Errorf("oldest snapshot vm-1 should have been evicted first, is still idle: %v", idles)
+	}
+	if !idles["vm-2"] || !idles["vm-3"] {
+		t.Errorf("expected vm-2 and vm-3 to remain idle, got %v", idles)
+	}
+}
+
+func TestEvictOverTotalBytesVictimOrdering(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), &SnapshotPolicy{MaxTotalBytes: 150})
+	defer mgr.Close()
+
+	const image = "test-image"
+	for _, id := range []string{"vm-1", "vm-2", "vm-3"} {
+		snap, err := mgr.InitSnapshot(id, image, "")
+		if err != nil {
+			t.Fatalf("InitSnapshot(%s): %s", id, err)
+		}
+		writeDummyFile(t, snap.GetMemFilePath(), 100)
+		writeDummyFile(t, snap.GetSnapFilePath(), 1)
+		if err := mgr.CommitSnapshot(id); err != nil {
+			t.Fatalf("CommitSnapshot(%s): %s", id, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	idles := idleIDs(mgr, image)
+	if idles["vm-1"] || idles["vm-2"] {
+		t.Errorf("older snapshots should have been evicted to satisfy MaxTotalBytes, got %v", idles)
+	}
+	if !idles["vm-3"] {
+		t.Errorf("expected newest snapshot vm-3 to remain idle, got %v", idles)
+	}
+}
+
+// TestEvictAgedOutKeepsParentWithLiveReplica proves evictAgedOut orders victims the same way
+// evictOverCount/evictOverTotalBytes do: a parent past MaxIdleAge is kept as long as it still has a live
+// idle replica, instead of being evicted out from under it just because the parent itself aged out.
+func TestEvictAgedOutKeepsParentWithLiveReplica(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), &SnapshotPolicy{MaxIdleAge: time.Hour})
+	defer mgr.Close()
+
+	const image = "test-image"
+	parent := commitTestSnapshot(t, mgr, "parent", image)
+	if err := mgr.Replicate(image, 1); err != nil {
+		t.Fatalf("Replicate: %s", err)
+	}
+
+	var replicaID string
+	for id := range idleIDs(mgr, image) {
+		if id != parent.GetId() {
+			replicaID = id
+		}
+	}
+	if replicaID == "" {
+		t.Fatalf("expected a replica to exist after Replicate")
+	}
+
+	// Back-date only the parent past MaxIdleAge; the replica stays fresh.
+	mgr.Lock()
+	mgr.lastUsed[parent.GetId()] = time.Now().Add(-2 * time.Hour)
+	mgr.Unlock()
+
+	mgr.evict()
+
+	idles := idleIDs(mgr, image)
+	if !idles[parent.GetId()] {
+		t.Fatalf("parent should survive aged-out eviction while its replica %s is still idle", replicaID)
+	}
+	if !idles[replicaID] {
+		t.Fatalf("replica %s should still be idle", replicaID)
+	}
+}
+
+// idleIDs returns the set of ids currently idle for image.
+func idleIDs(mgr *SnapshotManager, image string) map[string]bool {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	ids := make(map[string]bool)
+	for _, snap := range mgr.idleSnapshots[image] {
+		ids[snap.GetId()] = true
+	}
+	return ids
+}
+
+func writeDummyFile(t *testing.T, path string, size int) {
+	t.Helper()
+	if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+		t.Fatalf("writing dummy file %s: %s", path, err)
+	}
+}
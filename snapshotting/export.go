@@ -0,0 +1,275 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+)
+
+// exportManifestName is the tar member holding the JSON exportManifest, written first so Import can
+// validate before extracting the (much larger) snapshot members.
+const exportManifestName = "manifest.json"
+
+// exportManifest describes the members of an exported snapshot so Import can validate and place them, and
+// carries the kernel args and firecracker version the snapshot was created under, so the importing node can
+// tell whether it's actually bootable with its own firecracker binary and kernel cmdline before trusting it.
+type exportManifest struct {
+	Image              string            `json:"image"`
+	KernelArgs         string            `json:"kernel_args"`
+	FirecrackerVersion string            `json:"firecracker_version"`
+	GuestMemBytes      int64             `json:"guest_mem_bytes"`
+	Checksums          map[string]string `json:"checksums"` // tar member name -> hex sha256
+}
+
+// exportMembers lists the files making up a snapshot, relative to its snapDir, in the order they are
+// written to the export tar.
+var exportMembers = []string{"mem_file", "snap_file", "info_file"}
+
+func (snap *Snapshot) exportPaths() map[string]string {
+	return map[string]string{
+		"mem_file":  snap.GetMemFilePath(),
+		"snap_file": snap.GetSnapFilePath(),
+		"info_file": snap.GetInfoFilePath(),
+	}
+}
+
+// ExportSnapshot streams the snapshot identified by id to w as a tar archive containing its memory file,
+// block device snapshot, VMM state file and a manifest with their SHA256 checksums, so it can be
+// prewarmed onto another node instead of cold-booted there.
+func (mgr *SnapshotManager) ExportSnapshot(id string, w io.Writer) error {
+	snap, err := mgr.findSnapshot(id)
+	if err != nil {
+		return err
+	}
+
+	paths := snap.exportPaths()
+	manifest := exportManifest{
+		Image:              snap.Image,
+		KernelArgs:         mgr.kernelArgs,
+		FirecrackerVersion: mgr.firecrackerVersion,
+		Checksums:          make(map[string]string),
+	}
+
+	tw := tar.NewWriter(w)
+
+	for _, member := range exportMembers {
+		sum, err := sha256File(paths[member])
+		if err != nil {
+			return errors.Wrapf(err, "checksumming %s for snapshot %s", member, id)
+		}
+		manifest.Checksums[member] = sum
+	}
+	if info, err := os.Stat(paths["mem_file"]); err == nil {
+		manifest.GuestMemBytes = info.Size()
+	}
+
+	manifestBytes, err := json.Marshal(&manifest)
+	if err != nil {
+		return errors.Wrap(err, "marshalling export manifest")
+	}
+	if err := writeTarMember(tw, exportManifestName, manifestBytes); err != nil {
+		return err
+	}
+
+	for _, member := range exportMembers {
+		if err := writeTarFile(tw, member, paths[member]); err != nil {
+			return errors.Wrapf(err, "writing %s to export archive", member)
+		}
+	}
+
+	return tw.Close()
+}
+
+// ImportSnapshot reads a tar archive produced by ExportSnapshot, verifies it was built with this node's
+// kernel args and firecracker version (each check runs only when this node's value, set via
+// WithBootConfig, and the manifest's value are both non-empty), its checksums and a
+// size guard against the eviction policy, extracts it into a freshly allocated snap dir, and makes it
+// available as an idle snapshot through the same path CommitSnapshot uses. Any failure once the snap dir
+// has been created - a checksum mismatch, a torn read, a failed commit - cleans that snap dir back up
+// instead of leaving a half-written directory behind.
+func (mgr *SnapshotManager) ImportSnapshot(vmID string, r io.Reader) (*Snapshot, error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != exportManifestName {
+		return nil, errors.New("import archive must start with " + exportManifestName)
+	}
+
+	var manifest exportManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, errors.Wrap(err, "decoding export manifest")
+	}
+
+	if mgr.kernelArgs != "" && manifest.KernelArgs != "" && manifest.KernelArgs != mgr.kernelArgs {
+		return nil, errors.Errorf("imported snapshot was booted with kernel args %q, this node uses %q", manifest.KernelArgs, mgr.kernelArgs)
+	}
+	if mgr.firecrackerVersion != "" && manifest.FirecrackerVersion != "" && manifest.FirecrackerVersion != mgr.firecrackerVersion {
+		return nil, errors.Errorf("imported snapshot was created with firecracker %q, this node runs %q", manifest.FirecrackerVersion, mgr.firecrackerVersion)
+	}
+
+	if mgr.policy != nil && mgr.policy.MaxTotalBytes != 0 {
+		mgr.Lock()
+		idleBytes := mgr.idleBytesLocked()
+		mgr.Unlock()
+		if idleBytes+manifest.GuestMemBytes > mgr.policy.MaxTotalBytes {
+			return nil, errors.New("importing snapshot would exceed the configured snapshot policy's max total bytes")
+		}
+	}
+
+	snap := NewSnapshot(vmID, mgr.baseFolder, manifest.Image)
+	if err := snap.CreateSnapDir(); err != nil {
+		return nil, errors.Wrapf(err, "creating snapDir for imported snapshot %s", vmID)
+	}
+	paths := snap.exportPaths()
+
+	if err := extractImport(paths, &manifest, tr); err != nil {
+		if cerr := snap.Cleanup(); cerr != nil {
+			log.Warnf("failed to clean up partial import %s after %s: %s", vmID, err, cerr)
+		}
+		return nil, err
+	}
+
+	if err := mgr.commitIdle(snap); err != nil {
+		if cerr := snap.Cleanup(); cerr != nil {
+			log.Warnf("failed to clean up import %s after commit failure %s: %s", vmID, err, cerr)
+		}
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// extractImport reads every tar member of an import archive into its place under paths, verifying each
+// one's checksum against manifest as it goes. It's split out of ImportSnapshot purely so the caller can
+// clean up the partial snapDir on any failure without duplicating that cleanup at every return site.
+func extractImport(paths map[string]string, manifest *exportManifest, tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading import archive")
+		}
+
+		dest, ok := paths[hdr.Name]
+		if !ok {
+			continue
+		}
+
+		sum, err := writeFromTar(dest, tr)
+		if err != nil {
+			return errors.Wrapf(err, "extracting %s", hdr.Name)
+		}
+		if want := manifest.Checksums[hdr.Name]; want != "" && want != sum {
+			return errors.Errorf("checksum mismatch for %s: expected %s, got %s", hdr.Name, want, sum)
+		}
+	}
+}
+
+// findSnapshot looks up a snapshot by id across all three states, since an export can be requested for a
+// snapshot that happens to be idle, active or (best-effort) still finishing creation.
+func (mgr *SnapshotManager) findSnapshot(id string) (*Snapshot, error) {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	if snap, ok := mgr.activeSnapshots[id]; ok {
+		return snap, nil
+	}
+	if snap, ok := mgr.creatingSnapshots[id]; ok {
+		return snap, nil
+	}
+	for _, idles := range mgr.idleSnapshots {
+		for _, snap := range idles {
+			if snap.GetId() == id {
+				return snap, nil
+			}
+		}
+	}
+
+	return nil, errors.Errorf("no snapshot found with id %s", id)
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeTarMember(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(data)), Mode: 0o644}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Size: info.Size(), Mode: 0o644}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func writeFromTar(dest string, r io.Reader) (string, error) {
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,95 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// writeManifestOnlyArchive builds a minimal import tar containing just the manifest, optionally followed
+// by a mem_file member, so tests can exercise ImportSnapshot's validation paths without a full export.
+func writeManifestOnlyArchive(t *testing.T, manifest exportManifest, memContents []byte) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	manifestBytes, err := json.Marshal(&manifest)
+	if err != nil {
+		t.Fatalf("marshalling manifest: %s", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: exportManifestName, Size: int64(len(manifestBytes)), Mode: 0o644}); err != nil {
+		t.Fatalf("writing manifest header: %s", err)
+	}
+	if _, err := tw.Write(manifestBytes); err != nil {
+		t.Fatalf("writing manifest: %s", err)
+	}
+
+	if memContents != nil {
+		if err := tw.WriteHeader(&tar.Header{Name: "mem_file", Size: int64(len(memContents)), Mode: 0o644}); err != nil {
+			t.Fatalf("writing mem_file header: %s", err)
+		}
+		if _, err := tw.Write(memContents); err != nil {
+			t.Fatalf("writing mem_file: %s", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %s", err)
+	}
+	return &buf
+}
+
+func TestImportSnapshotCleansUpOnChecksumMismatch(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), nil)
+	defer mgr.Close()
+
+	manifest := exportManifest{Image: "test-image", Checksums: map[string]string{"mem_file": "deadbeef"}}
+	archive := writeManifestOnlyArchive(t, manifest, []byte("not what the checksum expects"))
+
+	const vmID = "imported-vm"
+	if _, err := mgr.ImportSnapshot(vmID, archive); err == nil {
+		t.Fatalf("expected ImportSnapshot to fail on checksum mismatch")
+	}
+
+	memPath := NewSnapshot(vmID, mgr.baseFolder, "test-image").GetMemFilePath()
+	if _, err := os.Stat(memPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial snap dir to be cleaned up after a failed import, stat err: %v", err)
+	}
+}
+
+func TestImportSnapshotRejectsFirecrackerVersionMismatch(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), nil, WithBootConfig("", "v1.5.0"))
+	defer mgr.Close()
+
+	manifest := exportManifest{Image: "test-image", FirecrackerVersion: "v1.4.0", Checksums: map[string]string{}}
+	archive := writeManifestOnlyArchive(t, manifest, nil)
+
+	if _, err := mgr.ImportSnapshot("imported-vm", archive); err == nil {
+		t.Fatalf("expected ImportSnapshot to reject a firecracker version mismatch")
+	}
+}
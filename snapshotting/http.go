@@ -0,0 +1,108 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RegisterHandlers mounts the snapshot manager's admin endpoints on mux so a vhive daemon can expose them
+// alongside its other routes. GET /snapshots/export?id=... streams a snapshot for a peer node to pull,
+// POST /snapshots/import accepts one produced by it, and GET /snapshots lists what the node currently
+// holds.
+func (mgr *SnapshotManager) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/snapshots", mgr.handleList)
+	mux.HandleFunc("/snapshots/export", mgr.handleExport)
+	mux.HandleFunc("/snapshots/import", mgr.handleImport)
+}
+
+// handleList answers GET /snapshots?image=...&state=...&minAge=...&sortBy=... with the node's snapshot
+// inventory, so operators can tell what it holds and which snapshots are hottest.
+func (mgr *SnapshotManager) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := ListFilter{
+		ImageSubstring: r.URL.Query().Get("image"),
+		SortBy:         r.URL.Query().Get("sortBy"),
+	}
+	if state := r.URL.Query().Get("state"); state != "" {
+		filter.States = strings.Split(state, ",")
+	}
+	if minAge := r.URL.Query().Get("minAge"); minAge != "" {
+		d, err := time.ParseDuration(minAge)
+		if err != nil {
+			http.Error(w, "invalid minAge: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.MinAge = d
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(mgr.ListSnapshots(filter))
+}
+
+func (mgr *SnapshotManager) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	if id == "" {
+		http.Error(w, "missing id query parameter", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := mgr.ExportSnapshot(id, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (mgr *SnapshotManager) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snap, err := mgr.ImportSnapshot(uuid.New().String(), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		ID    string `json:"id"`
+		Image string `json:"image"`
+	}{ID: snap.GetId(), Image: snap.Image})
+}
@@ -0,0 +1,140 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot states as reported by ListSnapshots.
+const (
+	StateCreating = "creating"
+	StateActive   = "active"
+	StateIdle     = "idle"
+)
+
+// SnapshotInfo is a point-in-time summary of a single snapshot, returned by ListSnapshots so operators
+// can answer what a node holds and which snapshots are hottest without reaching into manager internals.
+type SnapshotInfo struct {
+	ID          string
+	Image       string
+	State       string
+	CreatedAt   time.Time
+	LastUsedAt  time.Time
+	SizeBytes   int64
+	Description string
+}
+
+// ListFilter narrows down ListSnapshots' results.
+type ListFilter struct {
+	// ImageSubstring, if non-empty, keeps only snapshots whose image contains it.
+	ImageSubstring string
+	// States, if non-empty, keeps only snapshots in one of these states (StateCreating, StateActive,
+	// StateIdle).
+	States []string
+	// MinAge keeps only snapshots created at least this long ago.
+	MinAge time.Duration
+	// SortBy orders the result: "created", "last-used", "size" or "image". Defaults to "created".
+	SortBy string
+}
+
+// ListSnapshots returns a SnapshotInfo for every snapshot known to the manager, across all three states,
+// filtered and sorted per filter.
+func (mgr *SnapshotManager) ListSnapshots(filter ListFilter) []SnapshotInfo {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	var infos []SnapshotInfo
+	for _, snap := range mgr.creatingSnapshots {
+		infos = append(infos, mgr.snapshotInfoLocked(snap, StateCreating))
+	}
+	for _, snap := range mgr.activeSnapshots {
+		infos = append(infos, mgr.snapshotInfoLocked(snap, StateActive))
+	}
+	for _, idles := range mgr.idleSnapshots {
+		for _, snap := range idles {
+			infos = append(infos, mgr.snapshotInfoLocked(snap, StateIdle))
+		}
+	}
+
+	infos = filterSnapshots(infos, filter)
+	sortSnapshots(infos, filter.SortBy)
+
+	return infos
+}
+
+func (mgr *SnapshotManager) snapshotInfoLocked(snap *Snapshot, state string) SnapshotInfo {
+	id := snap.GetId()
+	return SnapshotInfo{
+		ID:          id,
+		Image:       snap.Image,
+		State:       state,
+		CreatedAt:   mgr.createdAt[id],
+		LastUsedAt:  mgr.lastUsed[id],
+		SizeBytes:   mgr.sizeBytes[id],
+		Description: mgr.description[id],
+	}
+}
+
+func filterSnapshots(infos []SnapshotInfo, filter ListFilter) []SnapshotInfo {
+	var states map[string]bool
+	if len(filter.States) > 0 {
+		states = make(map[string]bool, len(filter.States))
+		for _, s := range filter.States {
+			states[s] = true
+		}
+	}
+
+	kept := infos[:0]
+	for _, info := range infos {
+		if filter.ImageSubstring != "" && !strings.Contains(info.Image, filter.ImageSubstring) {
+			continue
+		}
+		if states != nil && !states[info.State] {
+			continue
+		}
+		if filter.MinAge != 0 && time.Since(info.CreatedAt) < filter.MinAge {
+			continue
+		}
+		kept = append(kept, info)
+	}
+
+	return kept
+}
+
+func sortSnapshots(infos []SnapshotInfo, sortBy string) {
+	less := func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) }
+
+	switch sortBy {
+	case "last-used":
+		less = func(i, j int) bool { return infos[i].LastUsedAt.Before(infos[j].LastUsedAt) }
+	case "size":
+		less = func(i, j int) bool { return infos[i].SizeBytes < infos[j].SizeBytes }
+	case "image":
+		less = func(i, j int) bool { return infos[i].Image < infos[j].Image }
+	}
+
+	sort.Slice(infos, less)
+}
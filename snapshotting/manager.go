@@ -23,12 +23,20 @@
 package snapshotting
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
+// evictionSweepInterval is how often the background eviction goroutine rechecks the policy, independent
+// of the checks already run inline from CommitSnapshot.
+const evictionSweepInterval = 1 * time.Minute
+
 // SnapshotManager manages snapshots stored on the node. Each snapshot can only be used by a single VM at
 // a time and thus is always in one of three states: creating, active or idle.
 type SnapshotManager struct {
@@ -40,67 +48,201 @@ type SnapshotManager struct {
 	// Offloaded snapshots available for reuse by new VMs (identified by the image name of the snapshot)
 	idleSnapshots map[string][]*Snapshot
 	baseFolder    string
+	// persister durably records committed snapshots so they survive a vHive restart
+	persister SnapshotPersister
+	// policy bounds how much idle snapshot state the manager keeps around; nil means unbounded
+	policy *SnapshotPolicy
+	// lastUsed tracks when a snapshot was last released to the idle pool, keyed by snapshot id, and
+	// backs the LRU eviction order
+	lastUsed map[string]time.Time
+	stopCh   chan struct{}
+
+	// imageConds lets AcquireSnapshot block until an idle snapshot for an image appears or creating
+	// it fails, instead of returning an error immediately when the pool is empty
+	imageConds map[string]*sync.Cond
+	// failedSnapshots holds the error from the most recent aborted creation for an image, so every
+	// waiter blocked in AcquireSnapshot for that image wakes up with that error instead of hanging
+	// forever. An entry is cleared when a fresh creation attempt for the image begins (in
+	// createSnapshot), not when a waiter reads it, so all waiters observe the failure rather than just
+	// whichever one reacquires the lock first.
+	failedSnapshots map[string]error
+	// inFlight tracks in-progress InitSnapshot calls per image so they can be coalesced when
+	// coalesceCreates is set
+	inFlight map[string]*creationFuture
+	// coalesceCreates makes InitSnapshot return the result of an already in-flight creation for the
+	// same image instead of starting a redundant cold boot
+	coalesceCreates bool
+
+	// createdAt, description and sizeBytes back ListSnapshots; all are keyed by snapshot id.
+	createdAt   map[string]time.Time
+	description map[string]string
+	sizeBytes   map[string]int64
+	// parentID maps a replica snapshot's id to the id of the committed snapshot it was replicated
+	// from. Snapshots created by InitSnapshot/CommitSnapshot never appear here.
+	parentID map[string]string
+
+	// kernelArgs and firecrackerVersion describe what this node boots its VMs with. They're stamped into
+	// every ExportSnapshot manifest and checked against on ImportSnapshot, so a peer node can tell whether
+	// an imported snapshot is actually bootable here. Both are empty (and unchecked) unless set with
+	// WithBootConfig.
+	kernelArgs         string
+	firecrackerVersion string
 }
 
 // Snapshot identified by VM id
 
-func NewSnapshotManager(baseFolder string) *SnapshotManager {
+func NewSnapshotManager(baseFolder string, policy *SnapshotPolicy, opts ...ManagerOption) *SnapshotManager {
 	manager := new(SnapshotManager)
 	manager.activeSnapshots = make(map[string]*Snapshot)
 	manager.creatingSnapshots = make(map[string]*Snapshot)
 	manager.idleSnapshots = make(map[string][]*Snapshot)
 	manager.baseFolder = baseFolder
+	manager.persister = NewJSONPersister(baseFolder)
+	manager.policy = policy
+	manager.lastUsed = make(map[string]time.Time)
+	manager.stopCh = make(chan struct{})
+	manager.imageConds = make(map[string]*sync.Cond)
+	manager.failedSnapshots = make(map[string]error)
+	manager.inFlight = make(map[string]*creationFuture)
+	manager.createdAt = make(map[string]time.Time)
+	manager.description = make(map[string]string)
+	manager.sizeBytes = make(map[string]int64)
+	manager.parentID = make(map[string]string)
+
+	for _, opt := range opts {
+		opt(manager)
+	}
 
-	// Clean & init basefolder
-	_ = os.RemoveAll(manager.baseFolder)
 	_ = os.MkdirAll(manager.baseFolder, os.ModePerm)
 
+	// Reconstruct idle snapshots left over from a previous run instead of wiping baseFolder, so an
+	// operator restarting vHive on a node doesn't have to re-boot every function VM to get its
+	// snapshot back.
+	snaps, err := manager.persister.Load()
+	if err != nil {
+		log.Warnf("failed to load persisted snapshots from %s: %s", baseFolder, err)
+		snaps = nil
+	}
+	now := time.Now()
+	for _, ps := range snaps {
+		snap := ps.Snapshot
+		manager.idleSnapshots[snap.Image] = append(manager.idleSnapshots[snap.Image], snap)
+		manager.lastUsed[snap.GetId()] = now
+		manager.createdAt[snap.GetId()] = ps.CreatedAt
+		manager.sizeBytes[snap.GetId()] = ps.SizeBytes
+	}
+
+	if policy != nil {
+		go manager.evictionLoop()
+	}
+
 	return manager
 }
 
-// AcquireSnapshot returns an idle snapshot if one is available for the given image
-func (mgr *SnapshotManager) AcquireSnapshot(image string) (*Snapshot, error) {
-	mgr.Lock()
-	defer mgr.Unlock()
+// Close stops the manager's background eviction goroutine. It is a no-op if no policy was configured.
+func (mgr *SnapshotManager) Close() {
+	if mgr.policy != nil {
+		close(mgr.stopCh)
+	}
+}
 
-	// Check if idle snapshot is available for the given image
-	idles, ok := mgr.idleSnapshots[image]
-	if !ok {
-		mgr.idleSnapshots[image] = []*Snapshot{}
-		return nil, errors.New(fmt.Sprintf("There is no snapshot available for image %s", image))
+func (mgr *SnapshotManager) evictionLoop() {
+	ticker := time.NewTicker(evictionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			mgr.evict()
+		case <-mgr.stopCh:
+			return
+		}
 	}
+}
 
-	// Return snapshot for supplied image
-	if len(idles) != 0 {
-		snp := idles[0]
-		mgr.idleSnapshots[image] = idles[1:]
-		mgr.activeSnapshots[snp.GetId()] = snp
-		return snp, nil
+// AcquireSnapshot returns an idle snapshot for the given image, preferring a replica over its parent. If
+// none is idle, it returns the error of the most recent aborted creation for image while that error is
+// still recorded; otherwise it blocks until a snapshot becomes idle, a creation for image is aborted, or
+// ctx is cancelled, whichever happens first. It blocks whether or not a creation for image is in flight.
+func (mgr *SnapshotManager) AcquireSnapshot(ctx context.Context, image string) (*Snapshot, error) {
+	mgr.Lock()
+	cond := mgr.getCondLocked(image)
+
+	// Wake cond.Wait below if ctx is cancelled while we're blocked on it.
+	ctxDone := make(chan struct{})
+	defer close(ctxDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			mgr.Lock()
+			cond.Broadcast()
+			mgr.Unlock()
+		case <-ctxDone:
+		}
+	}()
+
+	for {
+		if idles := mgr.idleSnapshots[image]; len(idles) != 0 {
+			// Prefer a replica over its parent so the parent stays idle and available as a
+			// replication source for as long as possible.
+			i := 0
+			for j, snap := range idles {
+				if _, isReplica := mgr.parentID[snap.GetId()]; isReplica {
+					i = j
+					break
+				}
+			}
+			snp := idles[i]
+			mgr.idleSnapshots[image] = append(idles[:i], idles[i+1:]...)
+			mgr.activeSnapshots[snp.GetId()] = snp
+			mgr.Unlock()
+			return snp, nil
+		}
+
+		if err, failed := mgr.failedSnapshots[image]; failed {
+			mgr.Unlock()
+			return nil, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			mgr.Unlock()
+			return nil, err
+		}
+
+		cond.Wait()
 	}
-	return nil, errors.New(fmt.Sprintf("There is no snapshot available fo rimage %s", image))
 }
 
 // ReleaseSnapshot releases the snapshot in use by the given VM for offloading so that it can get used to handle a new
 // VM creation.
 func (mgr *SnapshotManager) ReleaseSnapshot(vmID string) error {
 	mgr.Lock()
-	defer mgr.Unlock()
 
 	snap, present := mgr.activeSnapshots[vmID]
 	if !present {
+		mgr.Unlock()
 		return errors.New(fmt.Sprintf("Get: Snapshot for container %s does not exist", vmID))
 	}
 
 	// Move snapshot from active to idle state
 	delete(mgr.activeSnapshots, vmID)
 	mgr.idleSnapshots[snap.Image] = append(mgr.idleSnapshots[snap.Image], snap)
+	mgr.lastUsed[snap.GetId()] = time.Now()
+	cond := mgr.getCondLocked(snap.Image)
+
+	mgr.Unlock()
+	cond.Broadcast()
 
 	return nil
 }
 
 // InitSnapshot initializes a snapshot by initializing a new snapshot and moving it to the creating state. CommitSnapshot
-// must be run to finalize the snapshot creation and make the snapshot available for use
-func (mgr *SnapshotManager) InitSnapshot(vmID, image string) (*Snapshot, error) {
+// must be run to finalize the snapshot creation and make the snapshot available for use. If the manager was
+// configured with WithCoalesceCreates and a creation for image is already in flight, InitSnapshot does not start a
+// redundant cold boot: it waits for that creation to be committed or aborted, then acquires the result itself, the
+// same way a plain AcquireSnapshot caller would. It never hands out the in-progress creator's own *Snapshot, since a
+// snapshot can only be driven by a single VM at a time.
+func (mgr *SnapshotManager) InitSnapshot(vmID, image, description string) (*Snapshot, error) {
 	mgr.Lock()
 
 	if _, present := mgr.creatingSnapshots[vmID]; present {
@@ -108,9 +250,47 @@ func (mgr *SnapshotManager) InitSnapshot(vmID, image string) (*Snapshot, error)
 		return nil, errors.New(fmt.Sprintf("Add: Snapshot for vm %s already exists", vmID))
 	}
 
+	if mgr.coalesceCreates {
+		if future, present := mgr.inFlight[image]; present {
+			mgr.Unlock()
+			<-future.done
+			if future.err != nil {
+				return nil, future.err
+			}
+			return mgr.AcquireSnapshot(context.Background(), image)
+		}
+
+		future := &creationFuture{done: make(chan struct{}), vmID: vmID}
+		mgr.inFlight[image] = future
+		mgr.Unlock()
+
+		return mgr.createSnapshot(vmID, image, description)
+	}
+
+	mgr.Unlock()
+	return mgr.createSnapshot(vmID, image, description)
+}
+
+// createSnapshot does the actual work of InitSnapshot: invalidating any leftover manifest, allocating the
+// Snapshot object and its on-disk directory, and moving it into the creating state.
+func (mgr *SnapshotManager) createSnapshot(vmID, image, description string) (*Snapshot, error) {
+	// Invalidate any leftover manifest for this id before mutating its on-disk state, so a crash
+	// between here and the next CommitSnapshot never leaves a manifest pointing at a half-written
+	// snapshot.
+	if err := mgr.persister.Invalidate(vmID); err != nil {
+		return nil, errors.Wrapf(err, "invalidating manifest for vm %s", vmID)
+	}
+
 	// Create snapshot object and move into creating state
 	snap := NewSnapshot(vmID, mgr.baseFolder, image)
+	mgr.Lock()
+	// Clear any stale failure left by a previous aborted creation for this image now that a fresh
+	// attempt is underway, rather than when a waiter reads it, so every waiter blocked on the previous
+	// failure observes it before it's cleared for the next attempt.
+	delete(mgr.failedSnapshots, image)
 	mgr.creatingSnapshots[snap.GetId()] = snap
+	mgr.createdAt[snap.GetId()] = time.Now()
+	mgr.description[snap.GetId()] = description
 	mgr.Unlock()
 
 	// Create directory to store snapshot data
@@ -122,24 +302,97 @@ func (mgr *SnapshotManager) InitSnapshot(vmID, image string) (*Snapshot, error)
 	return snap, nil
 }
 
+// AbortSnapshot reports that the in-progress creation for vmID failed with err, moving it out of the
+// creating state and waking any goroutines blocked in AcquireSnapshot for that image so they can return
+// the error instead of waiting for a commit that will never come.
+func (mgr *SnapshotManager) AbortSnapshot(vmID string, err error) error {
+	mgr.Lock()
+
+	snap, present := mgr.creatingSnapshots[vmID]
+	if !present {
+		mgr.Unlock()
+		return errors.New(fmt.Sprintf("Abort: Snapshot for vm %s does not exist", vmID))
+	}
+	delete(mgr.creatingSnapshots, vmID)
+	mgr.failedSnapshots[snap.Image] = err
+	mgr.resolveInFlightLocked(snap.Image, vmID, err)
+	cond := mgr.getCondLocked(snap.Image)
+
+	mgr.Unlock()
+	cond.Broadcast()
+
+	return nil
+}
+
+// getCondLocked returns the condition variable waiters on image block on, creating it on first use. The
+// caller must hold mgr.Mutex.
+func (mgr *SnapshotManager) getCondLocked(image string) *sync.Cond {
+	cond, ok := mgr.imageConds[image]
+	if !ok {
+		cond = sync.NewCond(&mgr.Mutex)
+		mgr.imageConds[image] = cond
+	}
+	return cond
+}
+
+// resolveInFlightLocked resolves and removes the in-flight creation future for image, if one exists and
+// vmID is the creator it was opened for, waking every InitSnapshot caller coalesced onto it. The caller
+// must hold mgr.Mutex.
+func (mgr *SnapshotManager) resolveInFlightLocked(image, vmID string, err error) {
+	future, present := mgr.inFlight[image]
+	if !present || future.vmID != vmID {
+		return
+	}
+	delete(mgr.inFlight, image)
+	future.err = err
+	close(future.done)
+}
+
 // CommitSnapshot finalizes the snapshot creation and makes it available for use by moving it into the idle state.
 func (mgr *SnapshotManager) CommitSnapshot(vmID string) error {
 	mgr.Lock()
-	defer mgr.Unlock()
 
 	// Move snapshot from creating to idle state
 	snap, ok := mgr.creatingSnapshots[vmID]
 	if !ok {
+		mgr.Unlock()
 		return errors.New(fmt.Sprintf("There has no snapshot been created with vmID %s", vmID))
 	}
 	delete(mgr.creatingSnapshots, vmID)
+	mgr.resolveInFlightLocked(snap.Image, vmID, nil)
+	mgr.Unlock()
+
+	return mgr.commitIdle(snap)
+}
 
-	_, ok = mgr.idleSnapshots[snap.Image]
+// commitIdle makes snap available for use by moving it into the idle state. It is shared by
+// CommitSnapshot, which commits a snapshot that finished the creating state, and ImportSnapshot, which
+// commits a snapshot pulled in from a peer node.
+func (mgr *SnapshotManager) commitIdle(snap *Snapshot) error {
+	mgr.Lock()
+
+	_, ok := mgr.idleSnapshots[snap.Image]
 	if !ok {
 		mgr.idleSnapshots[snap.Image] = []*Snapshot{}
 	}
 
 	mgr.idleSnapshots[snap.Image] = append(mgr.idleSnapshots[snap.Image], snap)
+	mgr.sizeBytes[snap.GetId()] = dirSize(filepath.Dir(snap.GetInfoFilePath()))
+	mgr.lastUsed[snap.GetId()] = time.Now()
+	if _, ok := mgr.createdAt[snap.GetId()]; !ok {
+		mgr.createdAt[snap.GetId()] = time.Now()
+	}
+
+	if err := mgr.persister.Save(snap); err != nil {
+		mgr.Unlock()
+		return errors.Wrapf(err, "persisting snapshot %s", snap.GetId())
+	}
+
+	cond := mgr.getCondLocked(snap.Image)
+	mgr.Unlock()
+	cond.Broadcast()
+
+	mgr.evict()
 
 	return nil
 }
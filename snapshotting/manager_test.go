@@ -0,0 +1,195 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingPersister wraps a real SnapshotPersister and counts how many snapshots were actually
+// invalidated for a cold boot, so a coalescing test can assert only one real creation happened despite
+// many concurrent InitSnapshot callers.
+type countingPersister struct {
+	SnapshotPersister
+	invalidations int32
+}
+
+func (p *countingPersister) Invalidate(id string) error {
+	atomic.AddInt32(&p.invalidations, 1)
+	return p.SnapshotPersister.Invalidate(id)
+}
+
+// TestInitSnapshotCoalescesCreates drives many concurrent InitSnapshot calls for the same image through a
+// manager configured with WithCoalesceCreates, and asserts that only one of them actually cold-boots: the
+// rest wait for that creation to be committed and then acquire the committed snapshot themselves through
+// AcquireSnapshot, one after another, instead of being handed the creator's in-progress snapshot.
+func TestInitSnapshotCoalescesCreates(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), nil, WithCoalesceCreates())
+	defer mgr.Close()
+	cp := &countingPersister{SnapshotPersister: mgr.persister}
+	mgr.persister = cp
+
+	const image = "test-image"
+	const callers = 8
+
+	var wg sync.WaitGroup
+	var start sync.WaitGroup
+	start.Add(1)
+	results := make(chan *Snapshot, callers)
+	errs := make(chan error, callers)
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start.Wait()
+
+			vmID := fmt.Sprintf("vm-%d", i)
+			snap, err := mgr.InitSnapshot(vmID, image, "")
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			// The real creator commits its snapshot; every coalesced caller instead got back an
+			// already-idle snapshot through AcquireSnapshot and must release it again so the pool
+			// doesn't run dry for the remaining waiters.
+			if _, present := mgr.creatingSnapshotsContain(vmID); present {
+				// Give the other goroutines a chance to all reach InitSnapshot and coalesce onto this
+				// creation before it commits, so the test deterministically exercises coalescing
+				// instead of racing a fast commit against slow-to-schedule callers.
+				time.Sleep(20 * time.Millisecond)
+				writeDummyFile(t, snap.GetMemFilePath(), 1)
+				writeDummyFile(t, snap.GetSnapFilePath(), 1)
+				if err := mgr.CommitSnapshot(vmID); err != nil {
+					errs <- err
+					return
+				}
+			} else if err := mgr.ReleaseSnapshot(snap.GetId()); err != nil {
+				errs <- err
+				return
+			}
+
+			results <- snap
+		}(i)
+	}
+	start.Done()
+	wg.Wait()
+	close(results)
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("InitSnapshot: %s", err)
+	}
+
+	// Only one physical snapshot is ever created: the real creator commits it, and every coalesced
+	// caller acquires and releases that same snapshot in turn, so all results share its id.
+	seen := make(map[string]bool)
+	for snap := range results {
+		seen[snap.GetId()] = true
+	}
+	if len(seen) != 1 {
+		t.Errorf("expected all coalesced callers to share one physical snapshot, got %d distinct ids", len(seen))
+	}
+
+	if n := atomic.LoadInt32(&cp.invalidations); n != 1 {
+		t.Errorf("expected exactly one real cold boot, got %d", n)
+	}
+}
+
+// creatingSnapshotsContain reports whether vmID is currently in the creating state, used by the test above
+// to tell the real creator apart from a coalesced caller that got its result via AcquireSnapshot.
+func (mgr *SnapshotManager) creatingSnapshotsContain(vmID string) (*Snapshot, bool) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	snap, ok := mgr.creatingSnapshots[vmID]
+	return snap, ok
+}
+
+// TestAbortSnapshotWakesAllWaiters starts several concurrent AcquireSnapshot calls for an image with no
+// idle snapshots, aborts the in-progress creation, and asserts that every one of them wakes up with the
+// abort error instead of only the first to reacquire mgr.Mutex.
+func TestAbortSnapshotWakesAllWaiters(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), nil)
+	defer mgr.Close()
+
+	const image = "test-image"
+	if _, err := mgr.InitSnapshot("creator", image, ""); err != nil {
+		t.Fatalf("InitSnapshot: %s", err)
+	}
+
+	const waiters = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, waiters)
+
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mgr.AcquireSnapshot(context.Background(), image)
+			errs <- err
+		}()
+	}
+
+	// Give the waiters a chance to actually block on the condition variable before aborting.
+	waitUntilWaiting(t, mgr, image)
+	time.Sleep(20 * time.Millisecond)
+
+	bootErr := errors.New("cold boot failed")
+	if err := mgr.AbortSnapshot("creator", bootErr); err != nil {
+		t.Fatalf("AbortSnapshot: %s", err)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if !errors.Is(err, bootErr) {
+			t.Errorf("expected every waiter to observe %v, got %v", bootErr, err)
+		}
+	}
+}
+
+// waitUntilWaiting blocks until at least one goroutine has reached the condition variable for image, or
+// fails the test after a reasonable number of attempts. It relies on imageConds being created lazily by
+// AcquireSnapshot, which happens before a goroutine can start waiting; the caller still needs a short grace
+// period afterwards for the rest of the waiters to catch up.
+func waitUntilWaiting(t *testing.T, mgr *SnapshotManager, image string) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		mgr.Lock()
+		_, ok := mgr.imageConds[image]
+		mgr.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for a waiter to block on image %s", image)
+}
@@ -0,0 +1,214 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// manifestFileName is the name of the per-snapshot metadata file written next to the snapshot's
+// memory file, block device snapshot and VMM state file inside its snapDir.
+const manifestFileName = "manifest.json"
+
+// SnapshotPersister durably records the snapshots a SnapshotManager knows about so that they survive
+// a vHive restart. Save and Invalidate are expected to be called around any mutation of a snapshot's
+// on-disk state, invalidate-then-save, so that a crash in between never leaves a manifest pointing at
+// half-written data.
+type SnapshotPersister interface {
+	// Save persists the manifest for snap, overwriting any previous manifest for the same id.
+	Save(snap *Snapshot) error
+	// Invalidate removes the manifest for the snapshot identified by id, if any. It must be called
+	// before a snapshot's on-disk state is mutated so a crash mid-write is never mistaken for a valid
+	// snapshot on the next Load.
+	Invalidate(id string) error
+	// Load scans the persister's storage and reconstructs the snapshots it finds manifests for, along
+	// with the manifest metadata needed to repopulate a SnapshotManager's bookkeeping.
+	Load() ([]*PersistedSnapshot, error)
+}
+
+// PersistedSnapshot pairs a reconstructed Snapshot with the metadata Load read about it, so a
+// SnapshotManager can repopulate its createdAt/sizeBytes bookkeeping on restart instead of treating every
+// reloaded snapshot as freshly created and empty.
+type PersistedSnapshot struct {
+	Snapshot  *Snapshot
+	CreatedAt time.Time
+	SizeBytes int64
+}
+
+// manifest is the on-disk representation of a single snapshot, written as manifestFileName inside the
+// snapshot's own snapDir.
+type manifest struct {
+	VMID               string    `json:"vm_id"`
+	Image              string    `json:"image"`
+	MemFilePath        string    `json:"mem_file_path"`
+	SnapFilePath       string    `json:"snap_file_path"`
+	InfoFilePath       string    `json:"info_file_path"`
+	GuestMemSizeBytes  int64     `json:"guest_mem_size_bytes"`
+	GuestFileSizeBytes int64     `json:"guest_file_size_bytes"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+// JSONPersister is the default SnapshotPersister, storing one manifest.json per snapshot directory.
+type JSONPersister struct {
+	baseFolder string
+	// pruneOrphans controls whether Load deletes snapshot directories that have no manifest yet. It must
+	// be false for a persister used to inspect a baseFolder some other, possibly live, SnapshotManager
+	// owns, since a real snapshot there may simply be between CreateSnapDir and its first Save.
+	pruneOrphans bool
+}
+
+// NewJSONPersister creates a JSONPersister rooted at baseFolder, the same directory the SnapshotManager
+// stores its snapshot directories in. Load prunes orphan snapshot directories it finds there, which is
+// only safe because this manager owns baseFolder and nothing else is concurrently writing to it.
+func NewJSONPersister(baseFolder string) *JSONPersister {
+	return &JSONPersister{baseFolder: baseFolder, pruneOrphans: true}
+}
+
+// NewReadOnlyJSONPersister creates a JSONPersister for inspecting baseFolder without mutating it, for a
+// manager that doesn't own the directory (e.g. an operator CLI pointed at a live node's snapshot folder).
+// Load leaves orphan-looking directories in place instead of pruning them.
+func NewReadOnlyJSONPersister(baseFolder string) *JSONPersister {
+	return &JSONPersister{baseFolder: baseFolder, pruneOrphans: false}
+}
+
+// Save writes snap's manifest to its snapDir.
+func (p *JSONPersister) Save(snap *Snapshot) error {
+	memInfo, err := os.Stat(snap.GetMemFilePath())
+	if err != nil {
+		return errors.Wrapf(err, "statting mem file for snapshot %s", snap.GetId())
+	}
+
+	snapInfo, err := os.Stat(snap.GetSnapFilePath())
+	if err != nil {
+		return errors.Wrapf(err, "statting snap file for snapshot %s", snap.GetId())
+	}
+
+	m := manifest{
+		VMID:               snap.GetId(),
+		Image:              snap.Image,
+		MemFilePath:        snap.GetMemFilePath(),
+		SnapFilePath:       snap.GetSnapFilePath(),
+		InfoFilePath:       snap.GetInfoFilePath(),
+		GuestMemSizeBytes:  memInfo.Size(),
+		GuestFileSizeBytes: snapInfo.Size(),
+		CreatedAt:          time.Now(),
+	}
+
+	bytes, err := json.Marshal(&m)
+	if err != nil {
+		return errors.Wrapf(err, "marshalling manifest for snapshot %s", snap.GetId())
+	}
+
+	return os.WriteFile(p.manifestPath(snap.GetId()), bytes, 0o644)
+}
+
+// Invalidate removes the manifest for id, if one exists.
+func (p *JSONPersister) Invalidate(id string) error {
+	err := os.Remove(p.manifestPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "invalidating manifest for snapshot %s", id)
+	}
+	return nil
+}
+
+// Load scans baseFolder for snapshot directories and reconstructs a *Snapshot for each one that has a
+// valid manifest, along with the CreatedAt and on-disk size metadata the manifest recorded, so callers
+// can repopulate their own bookkeeping instead of treating every reloaded snapshot as freshly created.
+// Directories without a manifest are either orphans left behind by a crash between CreateSnapDir and the
+// first Save, or a real snapshot that simply hasn't reached its first Save yet - Load can't tell the two
+// apart, so p.pruneOrphans decides whether they're deleted (the owning manager's own persister) or left
+// alone (a read-only persister inspecting someone else's baseFolder). Manifests whose memory file or block
+// device snapshot file is missing are skipped with a warning rather than failing the whole scan; the VMM
+// state file is not checked.
+func (p *JSONPersister) Load() ([]*PersistedSnapshot, error) {
+	entries, err := os.ReadDir(p.baseFolder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "reading snapshot base folder")
+	}
+
+	var snaps []*PersistedSnapshot
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		snapDir := filepath.Join(p.baseFolder, entry.Name())
+		m, err := p.readManifest(entry.Name())
+		if err != nil {
+			if os.IsNotExist(err) {
+				if !p.pruneOrphans {
+					log.Warnf("skipping %s (no manifest yet): read-only, leaving it in place", snapDir)
+					continue
+				}
+				log.Warnf("pruning orphan snapshot directory %s (no manifest)", snapDir)
+				_ = os.RemoveAll(snapDir)
+				continue
+			}
+			return nil, errors.Wrapf(err, "reading manifest for %s", snapDir)
+		}
+
+		if _, err := os.Stat(m.MemFilePath); err != nil {
+			log.Warnf("skipping snapshot %s: mem file %s is missing", m.VMID, m.MemFilePath)
+			continue
+		}
+		if _, err := os.Stat(m.SnapFilePath); err != nil {
+			log.Warnf("skipping snapshot %s: snap file %s is missing", m.VMID, m.SnapFilePath)
+			continue
+		}
+
+		snap := NewSnapshot(m.VMID, p.baseFolder, m.Image)
+		snaps = append(snaps, &PersistedSnapshot{
+			Snapshot:  snap,
+			CreatedAt: m.CreatedAt,
+			SizeBytes: dirSize(snapDir),
+		})
+	}
+
+	return snaps, nil
+}
+
+func (p *JSONPersister) manifestPath(id string) string {
+	return filepath.Join(p.baseFolder, id, manifestFileName)
+}
+
+func (p *JSONPersister) readManifest(id string) (*manifest, error) {
+	bytes, err := os.ReadFile(p.manifestPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(bytes, &m); err != nil {
+		return nil, errors.Wrapf(err, "unmarshalling manifest for %s", id)
+	}
+
+	return &m, nil
+}
@@ -0,0 +1,165 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+)
+
+// Replicate materializes n cheap copy-on-write replicas of one committed idle snapshot for image, so a
+// burst of concurrent invocations against a hot image can be served without each one requiring its own
+// independently pre-created snapshot. Replicas share the parent's memory file via copy_file_range (or a
+// plain copy if the filesystem doesn't support it) and hard-link its block device snapshot, and are
+// tracked under the parent's id so AcquireSnapshot/ReleaseSnapshot/eviction treat them accordingly.
+func (mgr *SnapshotManager) Replicate(image string, n int) error {
+	parent, err := mgr.pinIdleForReplication(image)
+	if err != nil {
+		return err
+	}
+	defer mgr.unpinIdle(parent)
+
+	for i := 0; i < n; i++ {
+		replica := NewSnapshot(uuid.New().String(), mgr.baseFolder, image)
+		if err := replica.CreateSnapDir(); err != nil {
+			return errors.Wrapf(err, "creating snapDir for replica of %s", parent.GetId())
+		}
+
+		if err := reflinkOrCopy(parent.GetMemFilePath(), replica.GetMemFilePath()); err != nil {
+			return errors.Wrapf(err, "replicating mem file for replica of %s", parent.GetId())
+		}
+		if err := linkOrCopy(parent.GetSnapFilePath(), replica.GetSnapFilePath()); err != nil {
+			return errors.Wrapf(err, "replicating snap file for replica of %s", parent.GetId())
+		}
+		if err := linkOrCopy(parent.GetInfoFilePath(), replica.GetInfoFilePath()); err != nil {
+			return errors.Wrapf(err, "replicating info file for replica of %s", parent.GetId())
+		}
+
+		mgr.Lock()
+		mgr.parentID[replica.GetId()] = parent.GetId()
+		mgr.Unlock()
+
+		if err := mgr.commitIdle(replica); err != nil {
+			return errors.Wrapf(err, "committing replica of %s", parent.GetId())
+		}
+	}
+
+	return nil
+}
+
+// pinIdleForReplication removes one idle snapshot for image from mgr.idleSnapshots and returns it, so it
+// can be read from for the duration of Replicate without AcquireSnapshot handing it to a VM (which would
+// then actively mutate its files) or the eviction sweep deleting it mid-copy. The caller must restore it
+// with unpinIdle once done.
+func (mgr *SnapshotManager) pinIdleForReplication(image string) (*Snapshot, error) {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	idles := mgr.idleSnapshots[image]
+	if len(idles) == 0 {
+		return nil, errors.Errorf("no idle snapshot available to replicate for image %s", image)
+	}
+
+	parent := idles[0]
+	mgr.idleSnapshots[image] = append(idles[:0], idles[1:]...)
+	return parent, nil
+}
+
+// unpinIdle returns a snapshot removed by pinIdleForReplication back to the idle pool.
+func (mgr *SnapshotManager) unpinIdle(snap *Snapshot) {
+	mgr.Lock()
+	mgr.idleSnapshots[snap.Image] = append(mgr.idleSnapshots[snap.Image], snap)
+	cond := mgr.getCondLocked(snap.Image)
+	mgr.Unlock()
+
+	cond.Broadcast()
+}
+
+// reflinkOrCopy copies src to dst using copy_file_range, which shares the underlying pages
+// copy-on-write on filesystems that support reflinks, falling back to a plain byte-for-byte copy.
+func reflinkOrCopy(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	remaining := info.Size()
+	for remaining > 0 {
+		n, err := unix.CopyFileRange(int(in.Fd()), nil, int(out.Fd()), nil, int(remaining), 0)
+		if err != nil {
+			// Fall back to a regular copy for filesystems that don't support copy_file_range.
+			if _, err := out.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := in.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			_, err = io.Copy(out, in)
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		remaining -= int64(n)
+	}
+
+	return nil
+}
+
+// linkOrCopy hard-links dst to src so both share the same inode, falling back to a plain copy when the
+// two paths aren't on the same filesystem.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,250 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// commitTestSnapshot drives a real InitSnapshot/CommitSnapshot cycle for vmID/image, writing distinguishable
+// dummy content into the mem, snap and info files first so persister.Save's stat calls succeed and the
+// resulting files can be compared against replicas.
+func commitTestSnapshot(t *testing.T, mgr *SnapshotManager, vmID, image string) *Snapshot {
+	t.Helper()
+
+	snap, err := mgr.InitSnapshot(vmID, image, "")
+	if err != nil {
+		t.Fatalf("InitSnapshot(%s): %s", vmID, err)
+	}
+	writeDummyFile(t, snap.GetMemFilePath(), 64)
+	writeDummyFile(t, snap.GetSnapFilePath(), 8)
+	if err := os.WriteFile(snap.GetInfoFilePath(), []byte("vmm-state:"+vmID), 0o644); err != nil {
+		t.Fatalf("writing info file for %s: %s", vmID, err)
+	}
+	if err := mgr.CommitSnapshot(vmID); err != nil {
+		t.Fatalf("CommitSnapshot(%s): %s", vmID, err)
+	}
+	return snap
+}
+
+func TestReplicateCopiesAllThreeFiles(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), nil)
+	defer mgr.Close()
+
+	const image = "test-image"
+	parent := commitTestSnapshot(t, mgr, "parent", image)
+	parentInfo, err := os.ReadFile(parent.GetInfoFilePath())
+	if err != nil {
+		t.Fatalf("reading parent info file: %s", err)
+	}
+
+	const n = 4
+	if err := mgr.Replicate(image, n); err != nil {
+		t.Fatalf("Replicate: %s", err)
+	}
+
+	idles := idleIDs(mgr, image)
+	if len(idles) != n+1 {
+		t.Fatalf("expected %d idle snapshots (parent + replicas), got %d: %v", n+1, len(idles), idles)
+	}
+	if !idles[parent.GetId()] {
+		t.Fatalf("parent %s should still be idle after Replicate", parent.GetId())
+	}
+
+	for id := range idles {
+		if id == parent.GetId() {
+			continue
+		}
+		replica := NewSnapshot(id, mgr.baseFolder, image)
+		for _, path := range []string{replica.GetMemFilePath(), replica.GetSnapFilePath()} {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("replica %s missing file %s: %s", id, path, err)
+			}
+		}
+		info, err := os.ReadFile(replica.GetInfoFilePath())
+		if err != nil {
+			t.Errorf("replica %s missing info file: %s", id, err)
+			continue
+		}
+		if !bytes.Equal(info, parentInfo) {
+			t.Errorf("replica %s info file does not match parent's", id)
+		}
+	}
+}
+
+func TestPinIdleForReplicationRemovesAndRestoresParent(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), nil)
+	defer mgr.Close()
+
+	const image = "test-image"
+	parent := commitTestSnapshot(t, mgr, "parent", image)
+
+	pinned, err := mgr.pinIdleForReplication(image)
+	if err != nil {
+		t.Fatalf("pinIdleForReplication: %s", err)
+	}
+	if pinned.GetId() != parent.GetId() {
+		t.Fatalf("expected to pin parent %s, got %s", parent.GetId(), pinned.GetId())
+	}
+	if idleIDs(mgr, image)[parent.GetId()] {
+		t.Fatalf("pinned parent must not still be idle (and thus acquirable or evictable)")
+	}
+
+	mgr.unpinIdle(pinned)
+	if !idleIDs(mgr, image)[parent.GetId()] {
+		t.Fatalf("parent should be idle again after unpinIdle")
+	}
+}
+
+// TestReplicateKeepsParentUnavailableDuringReplication proves the parent snapshot can't be concurrently
+// acquired while Replicate is reading its files: pinning it out of the idle pool is enough to make a
+// concurrent AcquireSnapshot block until its deadline instead of racing the copy, and once unpinned the
+// parent can be acquired again.
+func TestReplicateKeepsParentUnavailableDuringReplication(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), nil)
+	defer mgr.Close()
+
+	const image = "test-image"
+	commitTestSnapshot(t, mgr, "parent", image)
+
+	pinned, err := mgr.pinIdleForReplication(image)
+	if err != nil {
+		t.Fatalf("pinIdleForReplication: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := mgr.AcquireSnapshot(ctx, image); err == nil {
+		t.Fatalf("AcquireSnapshot should not succeed while the only idle snapshot is pinned for replication")
+	}
+
+	mgr.unpinIdle(pinned)
+
+	snap, err := mgr.AcquireSnapshot(context.Background(), image)
+	if err != nil {
+		t.Fatalf("AcquireSnapshot after unpin: %s", err)
+	}
+	if snap.GetId() != pinned.GetId() {
+		t.Fatalf("expected to reacquire the unpinned parent, got %s", snap.GetId())
+	}
+}
+
+// TestReplicateConcurrentAcquireStress fires a burst of concurrent AcquireSnapshot calls against an image
+// backed by one committed parent and several replicas, the scenario Replicate exists for: a hot image
+// should absorb many simultaneous invocations from the replica pool instead of serializing on one snapshot.
+func TestReplicateConcurrentAcquireStress(t *testing.T) {
+	mgr := NewSnapshotManager(t.TempDir(), nil)
+	defer mgr.Close()
+
+	const image = "test-image"
+	const memFileSize = 4 << 20 // 4 MiB, large enough to make duplicated disk usage measurable
+	parent, err := mgr.InitSnapshot("parent", image, "")
+	if err != nil {
+		t.Fatalf("InitSnapshot: %s", err)
+	}
+	writeDummyFile(t, parent.GetMemFilePath(), memFileSize)
+	writeDummyFile(t, parent.GetSnapFilePath(), 8)
+	if err := os.WriteFile(parent.GetInfoFilePath(), []byte("vmm-state:parent"), 0o644); err != nil {
+		t.Fatalf("writing parent info file: %s", err)
+	}
+	if err := mgr.CommitSnapshot("parent"); err != nil {
+		t.Fatalf("CommitSnapshot: %s", err)
+	}
+
+	const replicas = 8
+	if err := mgr.Replicate(image, replicas); err != nil {
+		t.Fatalf("Replicate: %s", err)
+	}
+
+	idles := idleIDs(mgr, image)
+	if len(idles) != replicas+1 {
+		t.Fatalf("expected %d idle snapshots (parent + replicas), got %d: %v", replicas+1, len(idles), idles)
+	}
+
+	// Disk usage of the mem files is logged, not asserted. reflinkOrCopy shares pages via
+	// copy_file_range where the filesystem backing t.TempDir() supports it, and then the disk blocks
+	// allocated to all (replicas+1) mem files together come in under what that many fully independent
+	// copies would cost. Where the filesystem doesn't share pages this way, each replica costs a full
+	// copy, and the test logs that case too rather than failing.
+	independentCopyBytes := int64(replicas+1) * memFileSize
+	actualBytes := memFileBytesOnDisk(t, mgr, image, idles)
+	if actualBytes < independentCopyBytes {
+		t.Logf("replication used %d bytes on disk vs %d for %d independent copies (page sharing observed)", actualBytes, independentCopyBytes, replicas+1)
+	} else {
+		t.Logf("filesystem backing %s does not share copy_file_range pages here; replication used %d bytes for %d copies", mgr.baseFolder, actualBytes, replicas+1)
+	}
+
+	// 64 concurrent AcquireSnapshot/ReleaseSnapshot cycles against the image's 9 physical snapshots.
+	const callers = 64
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			snap, err := mgr.AcquireSnapshot(ctx, image)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := mgr.ReleaseSnapshot(snap.GetId()); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent acquire/release: %s", err)
+	}
+
+	if !idleIDs(mgr, image)[parent.GetId()] {
+		t.Fatalf("parent %s should be back in the idle pool once every caller released", parent.GetId())
+	}
+}
+
+// memFileBytesOnDisk sums the disk blocks actually allocated to the mem file of every snapshot id in ids.
+func memFileBytesOnDisk(t *testing.T, mgr *SnapshotManager, image string, ids map[string]bool) int64 {
+	t.Helper()
+
+	var total int64
+	for id := range ids {
+		path := NewSnapshot(id, mgr.baseFolder, image).GetMemFilePath()
+		var st unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil {
+			t.Fatalf("stat %s: %s", path, err)
+		}
+		total += st.Blocks * 512
+	}
+	return total
+}